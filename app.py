@@ -10,12 +10,17 @@ from langchain.agents import AgentType
 from langchain.agents import load_tools, initialize_agent, AgentType
 from langchain.chat_models import AzureChatOpenAI, ChatOpenAI
 from langchain.schema.output_parser import OutputParserException
+from langchain.tools.graphql.tool import BaseGraphQLTool
+from gql.transport.exceptions import TransportQueryError
+from graphql import GraphQLError, OperationDefinitionNode, OperationType, parse
 from langchain.utilities import GraphQLAPIWrapper
+from openai.error import InvalidRequestError, RateLimitError
 
-from callbacks.capturing_callback_handler import CapturingCallbackHandler, playback_callbacks
+from callbacks.capturing_callback_handler import CallbackType, CapturingCallbackHandler, load_records_from_file, playback_callbacks
 from callbacks.streamlit_callback_handler import StreamlitCallbackHandler
 
 from utils.clear_results import with_clear_container
+from utils.linkify import linkify
 
 st.set_page_config(
     page_title="Guac-AI-Mole",
@@ -37,24 +42,100 @@ for path in runs_dir.glob("*.pickle"):
 "Charting the Course for Secure Software Supply Chain"
 "Ask questions about your software supply chain and get answers from the Guac-AI-Mole!"
 
+
+def env_int(name: str, default: int, minimum: int) -> int:
+    """Read an integer environment variable, falling back to the default if it is invalid"""
+    try:
+        value = int(os.getenv(name, default))
+    except ValueError:
+        return default
+    return max(value, minimum)
+
+
+# Public demo: visitors can't change the provider settings, a cheap model is used
+# with capped steps and tokens, the terminal tool is disabled and custom
+# questions are only allowed if opted in.
+demo_mode = os.getenv("DEMO_MODE", "").lower() in ("1", "true", "yes")
+demo_custom_questions = os.getenv("DEMO_CUSTOM_QUESTIONS", "").lower() in ("1", "true", "yes")
+demo_max_steps = env_int("DEMO_MAX_STEPS", 5, 1)
+demo_max_tokens = env_int("DEMO_MAX_TOKENS", 500, 1)
+
+if demo_mode:
+    st.info("This is a public demo. Settings are fixed and the terminal tool is disabled.")
+
 openai_api_key = os.getenv("OPENAI_API_KEY")
-user_openai_api_key = st.sidebar.text_input(
-    "OpenAI API Key", type="password", help="Set this to your own OpenAI API key.", value=openai_api_key
-)
+if demo_mode:
+    # Widget values are sent to the browser, so the operator's key stays server side
+    user_openai_api_key = openai_api_key
+else:
+    user_openai_api_key = st.sidebar.text_input(
+        "OpenAI API Key", type="password", help="Set this to your own OpenAI API key.", value=openai_api_key
+    )
 
 openai_api_endpoint = os.getenv("OPENAI_API_ENDPOINT")
 user_openai_api_endpoint = st.sidebar.text_input(
-    "OpenAI API Endpoint", type="default", help="Set this to your own OpenAI endpoint.", value=openai_api_endpoint
+    "OpenAI API Endpoint", type="default", help="Set this to your own OpenAI endpoint.", value=openai_api_endpoint, disabled=demo_mode
 )
 
 openai_api_model = os.getenv("OPENAI_API_MODEL")
-user_openai_model = st.sidebar.text_input(
-    "OpenAI Model", type="default", help="Set this to your own OpenAI model or deployment name.", value=openai_api_model
+openai_api_fallback_model = os.getenv("OPENAI_API_FALLBACK_MODEL")
+if demo_mode:
+    # Public visitors get a cheap model and are never moved to a bigger fallback model
+    user_openai_model = os.getenv("DEMO_MODEL", "gpt-3.5-turbo")
+    user_openai_fallback_model = None
+else:
+    user_openai_model = st.sidebar.text_input(
+        "OpenAI Model", type="default", help="Set this to your own OpenAI model or deployment name.", value=openai_api_model
+    )
+    user_openai_fallback_model = st.sidebar.text_input(
+        "OpenAI Fallback Model", type="default", help="Optional model or deployment name to retry with on context length or rate limit errors.", value=openai_api_fallback_model
+    )
+
+VERBOSITY_INSTRUCTIONS = {
+    "brief": "Keep the final answer brief: one or two sentences with only the names that answer the question.",
+    "normal": "",
+    "detailed": "Give a detailed final answer: list every relevant package, image and vulnerability found and explain how they are related.",
+}
+
+verbosity_levels = list(VERBOSITY_INSTRUCTIONS.keys())
+answer_verbosity = os.getenv("ANSWER_VERBOSITY", "normal")
+if answer_verbosity not in verbosity_levels:
+    answer_verbosity = "normal"
+user_answer_verbosity = st.sidebar.selectbox(
+    "Answer Verbosity", verbosity_levels, help="Set how much detail the final answer should include.", index=verbosity_levels.index(answer_verbosity)
+)
+
+AUDIENCE_INSTRUCTIONS = {
+    "developer": "Write the final answer for a developer: focus on remediation. Only suggest an upgrade when the query results include the fixed version, otherwise say that no fix information is available. Do not make up versions or commands.",
+    "executive": "Write the final answer for an executive: summarize the overall risk and business impact without technical detail.",
+    "auditor": "Write the final answer for an auditor: cite the evidence for every statement, naming the GraphQL query used and the node ids, packages, images and vulnerability IDs it returned. Always select the id field in your queries.",
+}
+
+audiences = ["default"] + list(AUDIENCE_INSTRUCTIONS.keys())
+answer_audience = os.getenv("ANSWER_AUDIENCE", "default")
+if answer_audience not in audiences:
+    answer_audience = "default"
+user_answer_audience = st.sidebar.selectbox(
+    "Answer Audience", audiences, help="Set who the final answer is written for.", index=audiences.index(answer_audience)
 )
 
+agent_max_steps_limit = env_int("AGENT_MAX_STEPS_LIMIT", 30, 1)
+if demo_mode:
+    agent_max_steps_limit = min(agent_max_steps_limit, demo_max_steps)
+agent_max_steps = min(env_int("AGENT_MAX_STEPS", 15, 1), agent_max_steps_limit)
+user_agent_max_steps = st.sidebar.number_input(
+    "Agent Max Steps", min_value=1, max_value=agent_max_steps_limit, help="Set how many tool calls the agent may make to answer a question.", value=agent_max_steps, disabled=demo_mode
+)
+
+agent_max_tool_errors = env_int("AGENT_MAX_TOOL_ERRORS", 3, 0)
+
+# Mutations (e.g. ingestCertifyBad, ingestHasMetadata) change the graph, so they
+# are only allowed when the operator opts in, and never in demo mode
+guac_allow_mutations = os.getenv("GUAC_ALLOW_MUTATIONS", "").lower() in ("1", "true", "yes") and not demo_mode
+
 graphql_endpoint = os.getenv("GUAC_GRAPHQL_ENDPOINT")
 user_graphql_endpoint = st.sidebar.text_input(
-    "GUAC GraphQL Endpoint", type="default", help="Set this to your own GUAC GraphQL endpoint.", value=graphql_endpoint
+    "GUAC GraphQL Endpoint", type="default", help="Set this to your own GUAC GraphQL endpoint.", value=graphql_endpoint, disabled=demo_mode
 )
 
 def get_schema():
@@ -107,6 +188,19 @@ def get_schema():
     return simplified_schema
 
 
+FRESHNESS_INSTRUCTION = "Always state how current the data behind the answer is. When it relies on vulnerability scans, give the timeScanned of the scans you found. If you did not retrieve any timestamps, say that the age of the data is unknown. Never say something is safe without saying when it was last scanned."
+
+
+def answer_instructions() -> str:
+    """Instructions for the final answer from the verbosity and audience settings"""
+    verbosity = VERBOSITY_INSTRUCTIONS[user_answer_verbosity]
+    audience = AUDIENCE_INSTRUCTIONS.get(user_answer_audience, "")
+    if verbosity and audience:
+        # The audience decides what the answer must contain, verbosity only how long it is
+        verbosity += " If these conflict, keep everything the audience requires and be as short as possible otherwise."
+    return "\n    ".join(instruction for instruction in [FRESHNESS_INSTRUCTION, audience, verbosity] if instruction)
+
+
 @tool
 def answer_question(query: str):
     """Answer a question using graphql API"""
@@ -120,10 +214,22 @@ def answer_question(query: str):
     kubectl get pods --all-namespaces -o go-template --template='{{range .items}}{{range .spec.containers}}{{.image}} {{end}}{{end}}'
     """
 
+    running_images_instructions = f"""To check if an image is running, use the terminal tool to list all running images with kubectl. Example:
+    {image_example} Only execute this based on the graphql answer, determine if the image is running.
+
+    Consider the syntax as image name followed by a dash and tag. For example, if 'bar-latest' is returned as part of graphql query, and terminal output contains 'foo/bar:latest' then consider it as running."""
+    if demo_mode:
+        running_images_instructions = "The terminal tool is not available, so you cannot check whether an image is running. Say so if the question asks about running images."
+
+    mutation_instructions = "Only read from the graphql database with queries. Never send mutations."
+    if guac_allow_mutations:
+        mutation_instructions = "Use graphql queries to read from the database. Only send a mutation when the user explicitly asks to change the graph, such as certifying a package as bad or adding metadata, and say in the answer what was changed."
+
     gql_examples = """
     ## Use this query when user asks what are dependencies of an image. When querying for the dependencies of a given package, you must specify the package field. When the query is about images, the oci package type should be used.
     query IsDependencyQ1 {
     IsDependency(isDependencySpec: { package: { type: "oci" name: "alpine" }}) {
+    id
     dependencyPackage {
       type
         namespaces {
@@ -142,6 +248,7 @@ def answer_question(query: str):
         package: { type: "oci" }
         dependencyPackage: { name: "logrus" }
     }) {
+      id
       package {
         namespaces {
             namespace
@@ -153,9 +260,10 @@ def answer_question(query: str):
       }
     }
 
-    ## Use this query when user asks about a vulnerability id, this will return a package that has the vulnerability. You must query further with IsDependencyQ2 to see what images includes this package.
+    ## Use this query when user asks about a vulnerability id, this will return a package that has the vulnerability and when it was scanned. You must query further with IsDependencyQ2 to see what images includes this package.
     query CertifyVulnQ1 {
     CertifyVuln(certifyVulnSpec: {vulnerability: {vulnerabilityID: "dsa-5122-1"}}) {
+      id
       package {
         namespaces {
             names {
@@ -163,78 +271,415 @@ def answer_question(query: str):
             }
           }
         }
+      metadata {
+        timeScanned
+      }
       }
     }
+
+    ## Use this query when user asks about custom annotations on a package, such as its owning team, environment or criticality. Set key to the annotation name, or leave it out to list every annotation on the package.
+    query HasMetadataQ1 {
+    HasMetadata(hasMetadataSpec: {
+        subject: { package: { type: "oci" name: "alpine" }}
+        key: "team"
+    }) {
+      id
+      key
+      value
+      timestamp
+      subject {
+        ... on Package {
+          namespaces {
+            names {
+              name
+            }
+          }
+        }
+      }
+    }
+    }
     """
 
     prompt = f"""
     Do NOT, under any circumstances, use ``` anywhere.
 
-    To check if an image is running, use the terminal tool to list all running images with kubectl. Example:
-    {image_example} Only execute this based on the graphql answer, determine if the image is running.
+    {running_images_instructions}
+
+    {mutation_instructions}
 
-    Consider the syntax as image name followed by a dash and tag. For example, if 'bar-latest' is returned as part of graphql query, and terminal output contains 'foo/bar:latest' then consider it as running.
+    If you are unsure what a GUAC node or edge type means, use the explain_guac_schema tool before interpreting query results.
 
     Here are some example queries for the graphql endpoint described below:
     {gql_examples}
 
-    Answer the following question: {query} by using either terminal or the graphql database that has this schema {graphql_fields}. action_input should not contain a seperate query key. action_input should only have the query itself."""
+    Answer the following question: {query} by using either terminal or the graphql database that has this schema {graphql_fields}. action_input should not contain a seperate query key. action_input should only have the query itself.
+    {answer_instructions()}"""
 
     try:
-        result = agent.run(prompt)
+        result = run_agent(prompt)
+    except GraphQLErrorLimitExceeded:
+        # The agent already had its correction attempts, don't start it over
+        raise
     except Exception as e:
         prompt += f"\n\nThere was an error with the request.\nError: {e}\n\nPlease reformat GraphQL query (avoid issues with backticks if possible)."
-        result = agent.run(prompt)
+        result = run_agent(prompt)
 
     return result
 
 
-tools = []
-llm = None
+GUAC_SCHEMA_DOCS = {
+    "Package": "A software package identified by a purl, split into type, namespace, name and version nodes. Container images are packages of type oci.",
+    "Source": "A source code repository (for example a git repo), split into type, namespace, name and tag or commit.",
+    "Artifact": "A concrete build output identified by its digest (algorithm and hash), such as an image manifest or a binary.",
+    "Vulnerability": "A vulnerability identified by type (cve, ghsa, osv, ...) and vulnerabilityID.",
+    "IsDependency": "Package depends on dependencyPackage. Query with package set to find what something depends on, or with dependencyPackage set to find what depends on something.",
+    "IsOccurrence": "A package or source is found as a specific artifact digest. Use it to go between purls and digests.",
+    "HasSourceAt": "A package was built from a source repository. It says nothing about dependencies.",
+    "HasSBOM": "An SBOM document exists for a package or artifact, with its download location and digest.",
+    "HasSLSA": "SLSA provenance for an artifact: the builder and the materials it was built from.",
+    "CertifyVuln": "A scanner reported that a package is affected by a vulnerability, with scanner metadata and timeScanned.",
+    "CertifyVEXStatement": "A VEX statement about whether a package or artifact is affected by a vulnerability, with status and justification.",
+    "CertifyBad": "A package, source or artifact has been marked as bad, with a justification.",
+    "CertifyGood": "A package, source or artifact has been marked as good, with a justification.",
+    "CertifyLegal": "License information for a package or source: declared and discovered licenses (as SPDX expressions), attribution and the time it was scanned.",
+    "HasMetadata": "A custom key/value annotation on a package, source or artifact, such as an owning team, environment or criticality, with the time it was added.",
+    "PointOfContact": "Who to contact about a package, source or artifact: an email address and/or info, with a justification.",
+    "CertifyScorecard": "An OpenSSF Scorecard result for a source repository, with aggregate score and per-check scores.",
+    "PkgEqual": "Two package identifiers refer to the same package.",
+    "HashEqual": "Two artifact digests refer to the same artifact.",
+    "VulnEqual": "Two vulnerability IDs (for example a CVE and a GHSA) refer to the same vulnerability.",
+}
+
+
+@tool
+def explain_guac_schema(name: str) -> str:
+    """Explain what a GUAC node or edge type means (for example IsOccurrence or HasSourceAt). Input should be the type name, or "all" to list every type."""
+    name = name.strip().strip("'\"")
+    if name.lower() == "all":
+        return "\n".join(f"{key}: {value}" for key, value in GUAC_SCHEMA_DOCS.items())
+
+    for key, value in GUAC_SCHEMA_DOCS.items():
+        if key.lower() == name.lower():
+            return f"{key}: {value}"
+
+    return f"No documentation for {name}. Known types: {', '.join(GUAC_SCHEMA_DOCS.keys())}"
+
+
+def query_guac(query: str, variables: dict) -> dict:
+    """Run a GraphQL query against GUAC and return its data, raising on GraphQL errors"""
+    request = requests.post(user_graphql_endpoint, json={"query": query, "variables": variables})
+    json_output = request.json()
+    if json_output.get("errors"):
+        raise ValueError("; ".join(error["message"] for error in json_output["errors"]))
+    return json_output["data"]
+
+
+def parse_source(source: str) -> dict:
+    """Turn a source repository like github.com/org/repo into a GUAC SourceSpec"""
+    source = source.strip().strip("'\"")
+    for prefix in ("https://", "http://", "git+"):
+        if source.startswith(prefix):
+            source = source[len(prefix):]
+    source = source.removesuffix(".git").strip("/")
+    if "/" not in source:
+        return {"name": source}
+    namespace, name = source.rsplit("/", 1)
+    return {"namespace": namespace, "name": name}
+
+
+@tool
+def scorecard_trend(source: str) -> str:
+    """Compare the OpenSSF Scorecard results of a source repository over time and report how the aggregate score and each check changed. Input should be the source repository, for example github.com/kubernetes/client-go."""
+    query = """
+    query ScorecardTrend($source: SourceSpec!) {
+      scorecards(scorecardSpec: { source: $source }) {
+        scorecard {
+          timeScanned
+          aggregateScore
+          checks {
+            check
+            score
+          }
+        }
+      }
+    }"""
+    try:
+        data = query_guac(query, {"source": parse_source(source)})
+    except Exception as e:
+        return f"Failed to query scorecards for {source}: {e}"
+
+    scorecards = sorted((result["scorecard"] for result in data["scorecards"]), key=lambda scorecard: scorecard["timeScanned"])
+    if not scorecards:
+        return f"No scorecards found for {source}."
+
+    lines = [f"{scorecard['timeScanned']}: aggregate score {scorecard['aggregateScore']}" for scorecard in scorecards]
+    if len(scorecards) == 1:
+        lines.append("Only one scorecard was found, so there is no trend to compare.")
+        return "\n".join(lines)
+
+    first, last = scorecards[0], scorecards[-1]
+    lines.append(f"Changes from {first['timeScanned']} to {last['timeScanned']}:")
+    lines.append(f"Aggregate score: {first['aggregateScore']} -> {last['aggregateScore']} ({last['aggregateScore'] - first['aggregateScore']:+.1f})")
+    first_checks = {check["check"]: check["score"] for check in first["checks"]}
+    last_checks = {check["check"]: check["score"] for check in last["checks"]}
+    for check in sorted(first_checks.keys() | last_checks.keys()):
+        before, after = first_checks.get(check), last_checks.get(check)
+        if before is None or after is None:
+            lines.append(f"{check}: {before if before is not None else 'not checked'} -> {after if after is not None else 'not checked'}")
+        else:
+            lines.append(f"{check}: {before} -> {after} ({after - before:+d})")
+    return "\n".join(lines)
+
+
+def parse_package(package: str) -> dict:
+    """Turn a purl like pkg:oci/alpine or a plain package name into a GUAC PkgSpec"""
+    package = package.strip().strip("'\"")
+    if not package.startswith("pkg:"):
+        return {"name": package}
+    package_type, _, path = package[len("pkg:"):].partition("/")
+    path, _, version = path.partition("@")
+    spec = {"type": package_type}
+    if "/" in path:
+        spec["namespace"], spec["name"] = path.rsplit("/", 1)
+    else:
+        spec["name"] = path
+    if version:
+        spec["version"] = version
+    return spec
+
+
+# Dependencies checked for license data, one CertifyLegal query each
+SBOM_SCORE_MAX_LICENSE_CHECKS = 25
+
+
+@tool
+def sbom_completeness(package: str) -> str:
+    """Score how complete the SBOM of a package or image is (SBOM present, dependencies, dependency versions, licenses) and explain the gaps. Input should be a purl (for example pkg:oci/alpine) or a package name."""
+    spec = parse_package(package)
+    sbom_query = """
+    query SBOMs($package: PkgSpec!) {
+      HasSBOM(hasSBOMSpec: { subject: { package: $package }}) {
+        id
+      }
+    }"""
+    dependency_query = """
+    query Dependencies($package: PkgSpec!) {
+      IsDependency(isDependencySpec: { package: $package }) {
+        versionRange
+        dependencyPackage {
+          type
+          namespaces {
+            namespace
+            names {
+              name
+            }
+          }
+        }
+      }
+    }"""
+    license_query = """
+    query Licenses($package: PkgSpec!) {
+      CertifyLegal(certifyLegalSpec: { subject: { package: $package }}) {
+        id
+      }
+    }"""
+    try:
+        sboms = query_guac(sbom_query, {"package": spec})["HasSBOM"]
+        dependencies = query_guac(dependency_query, {"package": spec})["IsDependency"]
+    except Exception as e:
+        return f"Failed to query the SBOM of {package}: {e}"
+
+    packages = set()
+    for dependency in dependencies:
+        dependency_package = dependency["dependencyPackage"]
+        for namespace in dependency_package["namespaces"]:
+            for name in namespace["names"]:
+                packages.add((dependency_package["type"], namespace["namespace"], name["name"]))
+
+    gaps = []
+    if not sboms:
+        gaps.append("No SBOM (HasSBOM) is recorded for this package.")
+    if not dependencies:
+        gaps.append("The SBOM lists no dependencies (IsDependency).")
+
+    versioned = sum(1 for dependency in dependencies if dependency["versionRange"])
+    version_coverage = versioned / len(dependencies) if dependencies else 0
+    if dependencies and versioned < len(dependencies):
+        gaps.append(f"{len(dependencies) - versioned} of {len(dependencies)} dependencies have no version.")
+
+    checked = sorted(packages)[:SBOM_SCORE_MAX_LICENSE_CHECKS]
+    licensed = 0
+    for package_type, namespace, name in checked:
+        try:
+            if query_guac(license_query, {"package": {"type": package_type, "namespace": namespace, "name": name}})["CertifyLegal"]:
+                licensed += 1
+        except Exception as e:
+            return f"Failed to query the licenses of {name}: {e}"
+    license_coverage = licensed / len(checked) if checked else 0
+    if checked and licensed < len(checked):
+        gaps.append(f"{len(checked) - licensed} of {len(checked)} checked dependencies have no license data (CertifyLegal).")
+    if len(packages) > len(checked):
+        gaps.append(f"Only {len(checked)} of {len(packages)} dependencies were checked for licenses.")
+    gaps.append("Suppliers are not checked, as GUAC does not record them.")
+
+    score = 25 * bool(sboms) + 25 * bool(dependencies) + 25 * version_coverage + 25 * license_coverage
+    lines = [
+        f"SBOM completeness score for {package}: {score:.0f}/100",
+        f"SBOMs: {len(sboms)}",
+        f"Dependencies: {len(dependencies)} ({version_coverage:.0%} with versions)",
+        f"License coverage: {license_coverage:.0%} of {len(checked)} checked dependencies",
+        "Gaps:",
+    ]
+    return "\n".join(lines + [f"- {gap}" for gap in gaps])
+
+
+def is_fallback_error(e: Exception) -> bool:
+    """Whether the error is worth retrying with the fallback model"""
+    if isinstance(e, RateLimitError):
+        return True
+    return isinstance(e, InvalidRequestError) and e.code == "context_length_exceeded"
+
+
+def run_agent(prompt: str):
+    """Run the agent, retrying once with the fallback model on context length or rate limit errors
+
+    The fallback agent starts the question over, so any tool calls already made
+    by the first agent (including terminal commands) are run again.
+    """
+    reset_tool_errors(agent)
+    try:
+        return agent.run(prompt)
+    except (InvalidRequestError, RateLimitError) as e:
+        if fallback_agent is None or not is_fallback_error(e):
+            raise
+        print(f"Falling back to model {user_openai_fallback_model}: {e}")
+        st.session_state["fallback"] = {
+            "model": user_openai_fallback_model,
+            "reason": e.code or type(e).__name__,
+        }
+        reset_tool_errors(fallback_agent)
+        return fallback_agent.run(prompt)
 
-if user_openai_api_key:
-    enable_custom = True
 
+def new_llm(model: str):
+    """Create a chat model for the configured endpoint"""
     if user_openai_api_endpoint.endswith("azure.com"):
         print("Using Azure LLM")
-        llm = AzureChatOpenAI(
+        return AzureChatOpenAI(
             openai_api_key=user_openai_api_key,
             openai_api_base=user_openai_api_endpoint,
             openai_api_version="2023-08-01-preview",
             openai_api_type="azure",
-            deployment_name=user_openai_model,
-            temperature=0,
-            streaming=True,
-        )
-    else:
-        print("Using OpenAI or LocalAI LLM")
-        llm = ChatOpenAI(
-            openai_api_key=user_openai_api_key,
-            openai_api_base=user_openai_api_endpoint,
-            model_name=user_openai_model,
+            deployment_name=model,
             temperature=0,
+            max_tokens=demo_max_tokens if demo_mode else None,
             streaming=True,
         )
 
-    tools = load_tools(
-        ["graphql", "terminal"],
-        graphql_endpoint=user_graphql_endpoint,
-        llm=llm,
+    print("Using OpenAI or LocalAI LLM")
+    return ChatOpenAI(
+        openai_api_key=user_openai_api_key,
+        openai_api_base=user_openai_api_endpoint,
+        model_name=model,
+        temperature=0,
+        max_tokens=demo_max_tokens if demo_mode else None,
+        streaming=True,
     )
 
-    # Initialize agent
-    agent = initialize_agent(
+
+def is_mutation(query: str) -> bool:
+    """Whether the GraphQL document contains a mutation operation"""
+    try:
+        document = parse(query)
+    except GraphQLError:
+        # Let the GraphQL tool report the syntax error
+        return False
+    return any(
+        isinstance(definition, OperationDefinitionNode) and definition.operation == OperationType.MUTATION
+        for definition in document.definitions
+    )
+
+
+class GraphQLErrorLimitExceeded(Exception):
+    """Raised when the agent keeps sending GraphQL queries that fail"""
+
+
+class GraphQLTool(BaseGraphQLTool):
+    """GraphQL tool that returns query errors to the agent so it can correct the query
+
+    Up to max_errors failed attempts in a row are returned to the agent, after
+    which GraphQLErrorLimitExceeded is raised and the question is stopped. Transport errors (e.g. GUAC being unreachable)
+    are always raised, as rewriting the query can't fix them.
+    """
+
+    max_errors: int = 3
+    errors: int = 0
+    allow_mutations: bool = False
+
+    def _run(self, tool_input: str, run_manager=None) -> str:
+        if not self.allow_mutations and is_mutation(tool_input):
+            return "Mutations are not allowed. Only use GraphQL queries to read from GUAC."
+        try:
+            result = super()._run(tool_input, run_manager)
+        except (TransportQueryError, GraphQLError) as e:
+            self.errors += 1
+            if self.errors > self.max_errors:
+                raise GraphQLErrorLimitExceeded(
+                    f"Stopped after {self.errors} failed GraphQL queries in a row. Last error: {e}") from e
+            return f"The GraphQL query failed with error: {e}\nFix the query and try again."
+
+        self.errors = 0
+        return result
+
+
+def reset_tool_errors(agent):
+    """Reset the GraphQL error count so each run gets its own correction attempts"""
+    for agent_tool in agent.tools:
+        if isinstance(agent_tool, GraphQLTool):
+            agent_tool.errors = 0
+
+
+def new_agent(llm):
+    """Create an agent with the graphql and terminal tools and the GUAC helper tools"""
+    tools = [] if demo_mode else load_tools(["terminal"], llm=llm)
+    tools.append(GraphQLTool(
+        graphql_wrapper=GraphQLAPIWrapper(graphql_endpoint=user_graphql_endpoint),
+        max_errors=agent_max_tool_errors,
+        allow_mutations=guac_allow_mutations,
+    ))
+    tools.append(explain_guac_schema)
+    tools.append(scorecard_trend)
+    tools.append(sbom_completeness)
+
+    return initialize_agent(
         tools,
         llm,
         agent=AgentType.CHAT_ZERO_SHOT_REACT_DESCRIPTION,
+        max_iterations=int(user_agent_max_steps),
         verbose=True,
     )
+
+
+llm = None
+fallback_agent = None
+
+if user_openai_api_key and (not demo_mode or demo_custom_questions):
+    enable_custom = True
+
+    # Initialize agent
+    llm = new_llm(user_openai_model)
+    agent = new_agent(llm)
+
+    if user_openai_fallback_model:
+        fallback_agent = new_agent(new_llm(user_openai_fallback_model))
 else:
     enable_custom = False
 
 
 with st.form(key="form"):
-    if not enable_custom:
+    if not enable_custom and demo_mode:
+        "Ask one of the sample questions."
+    elif not enable_custom:
         "Ask one of the sample questions, or enter your API Key in the sidebar to ask your own custom questions."
     prefilled = (
         st.selectbox(
@@ -259,6 +704,8 @@ if with_clear_container(submit_clicked):
 
     answer_container = output_container.chat_message("assistant", avatar="🥑")
     st_callback = StreamlitCallbackHandler(answer_container)
+    st.session_state.pop("fallback", None)
+    fallback = None
 
     # If we've saved this question, play it back instead of actually running LangChain
     # (so that we don't exhaust our API calls unnecessarily)
@@ -269,8 +716,11 @@ if with_clear_container(submit_clicked):
         session_name = SAVED_SESSIONS[path_user_input]
         session_path = Path(__file__).parent / "runs" / session_name
         print(f"Playing saved session: {session_path}")
+        records = load_records_from_file(str(session_path))
         answer = playback_callbacks(
-            [st_callback], str(session_path), max_pause_time=1)
+            [st_callback], records, max_pause_time=1)
+        fallback = next((record["kwargs"]["fallback"] for record in records
+                         if record["callback_type"] == CallbackType.ON_TEXT and "fallback" in record["kwargs"]), None)
     else:
         print(f"Running LangChain: {user_input} because not in SAVED_SESSIONS")
         capturing_callback = CapturingCallbackHandler()
@@ -279,7 +729,20 @@ if with_clear_container(submit_clicked):
                                      st_callback, capturing_callback])
         except OutputParserException as e:
             answer = e.args[0].split("LLM output: ")[1]
-        pickle_filename = user_input.replace(" ", "_") + ".pickle"
-        capturing_callback.dump_records_to_file(runs_dir / pickle_filename)
-
-    answer_container.write(answer)
+        except GraphQLErrorLimitExceeded as e:
+            answer = str(e)
+        # Record the fallback decision in the saved run so playback shows it too
+        fallback = st.session_state.get("fallback")
+        if fallback:
+            capturing_callback.on_text(
+                f"Answered by fallback model {fallback['model']}", fallback=fallback)
+        # Visitor questions would become sample questions for everyone else
+        if not demo_mode:
+            pickle_filename = user_input.replace(" ", "_") + ".pickle"
+            capturing_callback.dump_records_to_file(runs_dir / pickle_filename)
+
+    answer_container.write(linkify(answer))
+
+    if fallback:
+        answer_container.caption(
+            f"Answered by fallback model {fallback['model']} ({fallback['reason']})")
@@ -89,13 +89,13 @@ def playback_callbacks(
             elif record["callback_type"] == CallbackType.ON_AGENT_FINISH:
                 handler.on_agent_finish(*record["args"], **record["kwargs"])
 
-    # TODO(sertac): uncomment after fixing the issue
-    # Return the agent's result
-    # for record in records:
-    #     if record["callback_type"] == CallbackType.ON_AGENT_FINISH:
-    #         return record["args"][0][0]["output"]
+    # Return the agent's result. Recorded runs only capture the answer_question
+    # tool, so its last output is the answer.
+    for record in reversed(records):
+        if record["callback_type"] == CallbackType.ON_TOOL_END:
+            return record["args"][0]
 
-    # return "[Missing Agent Result]"
+    return "[Missing Agent Result]"
 
 
 class CapturingCallbackHandler(BaseCallbackHandler):
@@ -0,0 +1,50 @@
+import re
+from urllib.parse import quote, unquote
+
+
+# Parts of a markdown answer that must be left as they are: fenced code blocks,
+# code spans, existing links and bare URLs.
+SKIP_PATTERN = re.compile(r"(```.*?```|`[^`\n]*`|\[[^\]\n]*\]\([^)\n]*\)|<[a-z]+://[^>\n]*>|[a-z]+://[^\s)]+)", re.IGNORECASE | re.DOTALL)
+CVE_PATTERN = re.compile(r"(?<![\w-])(CVE-\d{4}-\d{4,})(?![\w-])", re.IGNORECASE)
+GHSA_PATTERN = re.compile(r"(?<![\w-])(GHSA(?:-[0-9a-z]{4}){3})(?![\w-])", re.IGNORECASE)
+PURL_PATTERN = re.compile(r"(?<![\w/-])pkg:([a-z]+)/([^\s@?#)\]]+)@([^\s?#)\]]+?)(?:[?#][^\s)\]]*?)?(?=[.,;:]?(?:\s|$|\)))", re.IGNORECASE)
+
+# deps.dev systems by purl type, and the separator it uses between namespace and name
+DEPS_DEV_SYSTEMS = {
+    "npm": ("npm", "/"),
+    "golang": ("go", "/"),
+    "maven": ("maven", ":"),
+    "pypi": ("pypi", "/"),
+    "cargo": ("cargo", "/"),
+    "nuget": ("nuget", "/"),
+}
+
+
+def purl_link(match: re.Match) -> str:
+    """Link a purl to its deps.dev page, or leave it as is if deps.dev doesn't know the ecosystem."""
+    purl, purl_type, name, version = match.group(0), match.group(1).lower(), match.group(2), match.group(3)
+    if purl_type not in DEPS_DEV_SYSTEMS:
+        return purl
+    system, separator = DEPS_DEV_SYSTEMS[purl_type]
+    name = quote(unquote(name).replace("/", separator), safe="")
+    return f"[{purl}](https://deps.dev/{system}/{name}/{quote(unquote(version), safe='')})"
+
+
+def linkify_text(text: str) -> str:
+    """Link CVE and GHSA IDs and purls in markdown text that has no code or links."""
+    text = CVE_PATTERN.sub(
+        lambda m: f"[{m.group(1)}](https://nvd.nist.gov/vuln/detail/{m.group(1).upper()})", text)
+    text = GHSA_PATTERN.sub(
+        lambda m: f"[{m.group(1)}](https://github.com/advisories/GHSA{m.group(1)[4:].lower()})", text)
+    text = PURL_PATTERN.sub(purl_link, text)
+    return text
+
+
+def linkify(text: str) -> str:
+    """Turn CVE and GHSA IDs in a markdown answer into links to their advisories, and purls into links to deps.dev."""
+    if not isinstance(text, str):
+        return text
+
+    # re.split with a capturing group puts the skipped parts at odd indexes
+    parts = SKIP_PATTERN.split(text)
+    return "".join(part if i % 2 else linkify_text(part) for i, part in enumerate(parts))